@@ -3,15 +3,20 @@ package snowflake
 import (
 	"context"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
 	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
 	nurl "net/url"
+	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"go.uber.org/atomic"
 
@@ -19,6 +24,7 @@ import (
 	"github.com/hashicorp/go-multierror"
 	"github.com/lib/pq"
 	sf "github.com/snowflakedb/gosnowflake"
+	"github.com/youmark/pkcs8"
 )
 
 func init() {
@@ -34,22 +40,132 @@ var (
 	ErrNoPassword         = fmt.Errorf("no password")
 	ErrNoSchema           = fmt.Errorf("no schema")
 	ErrNoSchemaOrDatabase = fmt.Errorf("no schema/database name")
+	ErrNoToken            = fmt.Errorf("no token")
 )
 
 type Config struct {
 	MigrationsTable string
 	DatabaseName    string
+	SchemaName      string
+
+	// LockTimeout bounds how long Lock polls for the distributed advisory
+	// lock before giving up with database.ErrLocked. Zero means
+	// defaultLockTimeout.
+	LockTimeout time.Duration
+
+	// LockStaleAfter is how long a held advisory lock is honored before a
+	// new acquirer is allowed to steal it, on the assumption that whatever
+	// held it has crashed or been killed without calling Unlock. Zero
+	// means defaultLockStaleAfter.
+	LockStaleAfter time.Duration
+
+	// MultiStatementTransaction wraps Run's per-statement execution in a
+	// single transaction, so a failing statement rolls back everything
+	// that ran before it.
+	MultiStatementTransaction bool
+
+	// MigrationsTableSchema places the migrations table (and its history
+	// table) in a dedicated schema instead of the connection's current
+	// schema.
+	MigrationsTableSchema string
+
+	// MigrationsTableTransient creates the migrations table (and its
+	// history table) as TRANSIENT, avoiding Snowflake's fail-safe storage
+	// cost for what is disposable bookkeeping data.
+	MigrationsTableTransient bool
+
+	// MigrationsTableUnquoted leaves the migrations table identifier
+	// unquoted, so Snowflake upper-cases and normalizes it rather than
+	// preserving the case given in MigrationsTable.
+	MigrationsTableUnquoted bool
 }
 
+// defaultLockTimeout is used when Config.LockTimeout is unset.
+const defaultLockTimeout = 15 * time.Second
+
+// defaultLockStaleAfter is used when Config.LockStaleAfter is unset.
+const defaultLockStaleAfter = 10 * time.Minute
+
 type Snowflake struct {
 	isLocked atomic.Bool
 	conn     *sql.Conn
 	db       *sql.DB
 
+	// lastRunDuration is how long the most recent call to Run took,
+	// consumed (and reset) by the following SetVersion call to populate
+	// the history table's execution_ms column.
+	lastRunDuration time.Duration
+
 	// Open and WithInstance need to guarantee that config is never nil
 	config *Config
 }
 
+// quoteIdentifier double-quotes name, preserving its case, unless the
+// driver was configured via x-migrations-table-quoted=false to leave
+// migrations-table identifiers unquoted.
+func (p *Snowflake) quoteIdentifier(name string) string {
+	if p.config.MigrationsTableUnquoted {
+		return name
+	}
+	return `"` + name + `"`
+}
+
+// qualifyIdentifier quotes name (per quoteIdentifier) and, if
+// MigrationsTableSchema is set, qualifies it with that schema.
+func (p *Snowflake) qualifyIdentifier(name string) string {
+	ident := p.quoteIdentifier(name)
+	if p.config.MigrationsTableSchema != "" {
+		return p.quoteIdentifier(p.config.MigrationsTableSchema) + "." + ident
+	}
+	return ident
+}
+
+// migrationsTableIdent is the schema-qualified, quoted identifier of the
+// migrations table.
+func (p *Snowflake) migrationsTableIdent() string {
+	return p.qualifyIdentifier(p.config.MigrationsTable)
+}
+
+// migrationsTableNameForComparison is MigrationsTable as Snowflake actually
+// stores it, for binding into an information_schema.tables.table_name
+// comparison. When MigrationsTableUnquoted is set, the table was created
+// with an unquoted identifier, which Snowflake folds to upper case; binding
+// the configured name as-is would then never match, silently defeating the
+// existence check this is used for.
+func (p *Snowflake) migrationsTableNameForComparison() string {
+	if p.config.MigrationsTableUnquoted {
+		return strings.ToUpper(p.config.MigrationsTable)
+	}
+	return p.config.MigrationsTable
+}
+
+// historyTableIdent is the schema-qualified, quoted identifier of the
+// append-only table that records every version transition, read back by
+// History.
+func (p *Snowflake) historyTableIdent() string {
+	return p.qualifyIdentifier(p.config.MigrationsTable + "_history")
+}
+
+// schemaCondition returns a SQL fragment (and its bind argument, if any)
+// that filters an information_schema query down to the migrations
+// table's schema. With no schema override that is the connection's
+// current schema, compared against current_schema() directly so the case
+// Snowflake stored it in never matters. With MigrationsTableSchema set,
+// the bound value is spelled the way qualifyIdentifier refers to the
+// schema: upper-cased when MigrationsTableUnquoted is set (Snowflake folds
+// unquoted identifiers to upper case when storing them), as configured
+// otherwise (a quoted identifier keeps its case).
+func (p *Snowflake) schemaCondition(paramIndex int) (string, []interface{}) {
+	if p.config.MigrationsTableSchema == "" {
+		return `table_schema = (SELECT current_schema())`, nil
+	}
+	schema := p.config.MigrationsTableSchema
+	if p.config.MigrationsTableUnquoted {
+		schema = strings.ToUpper(schema)
+	}
+	return fmt.Sprintf("table_schema = $%d", paramIndex), []interface{}{schema}
+}
+
 func WithInstance(instance *sql.DB, config *Config) (database.Driver, error) {
 	if config == nil {
 		return nil, ErrNilConfig
@@ -74,6 +190,20 @@ func WithInstance(instance *sql.DB, config *Config) (database.Driver, error) {
 		config.DatabaseName = databaseName
 	}
 
+	if config.SchemaName == "" {
+		query := `SELECT CURRENT_SCHEMA()`
+		var schemaName string
+		if err := instance.QueryRow(query).Scan(&schemaName); err != nil {
+			return nil, &database.Error{OrigErr: err, Query: []byte(query)}
+		}
+
+		if len(schemaName) == 0 {
+			return nil, ErrNoSchema
+		}
+
+		config.SchemaName = schemaName
+	}
+
 	if len(config.MigrationsTable) == 0 {
 		config.MigrationsTable = DefaultMigrationsTable
 	}
@@ -102,12 +232,6 @@ func (p *Snowflake) Open(url string) (database.Driver, error) {
 		return nil, err
 	}
 
-	password, isPasswordSet := purl.User.Password()
-	if !isPasswordSet {
-		return nil, ErrNoPassword
-	}
-	fmt.Printf("Password: %s\n", password)
-
 	splitPath := strings.Split(purl.Path, "/")
 	if len(splitPath) < 3 {
 		return nil, ErrNoSchemaOrDatabase
@@ -123,26 +247,70 @@ func (p *Snowflake) Open(url string) (database.Driver, error) {
 		return nil, ErrNoSchema
 	}
 
-	// auth := purl.Query().Get("authentication")
-	pKeyStr := strings.ReplaceAll(purl.Query().Get("privateKey"), `\n`, "\n")
-	pKey, err := GetPrivateKey(pKeyStr)
-	fmt.Printf("private key is %s\n\n", pKeyStr)
+	authType, err := parseAuthenticator(purl.Query().Get("authenticator"))
 	if err != nil {
 		return nil, err
 	}
+
 	role := purl.Query().Get("role")
+	warehouse := purl.Query().Get("warehouse")
 
 	cfg := &sf.Config{
-		Account: purl.Host,
-		// Host:          purl.Host + ".snowflakecomputing.com",
+		Account:       purl.Host,
 		User:          purl.User.Username(),
-		Authenticator: sf.AuthTypeJwt,
+		Authenticator: authType,
 		Role:          role,
-		PrivateKey:    pKey,
-		// Password:      password,
-		Database:  database,
-		Schema:    schema,
-		Warehouse: "SF_NATIVE_EXP_WH",
+		Database:      database,
+		Schema:        schema,
+		Warehouse:     warehouse,
+	}
+
+	switch authType {
+	case sf.AuthTypeJwt:
+		pKeyStr, err := readPrivateKeyString(purl)
+		if err != nil {
+			return nil, err
+		}
+		pKey, err := GetPrivateKey(pKeyStr, purl.Query().Get("privateKeyPassphrase"))
+		if err != nil {
+			return nil, err
+		}
+		cfg.PrivateKey = pKey
+
+	case sf.AuthTypeSnowflake, sf.AuthTypeOkta:
+		password, isPasswordSet := purl.User.Password()
+		if !isPasswordSet {
+			return nil, ErrNoPassword
+		}
+		cfg.Password = password
+
+		if authType == sf.AuthTypeOkta {
+			oktaURL, err := nurl.Parse(purl.Query().Get("authenticator"))
+			if err != nil {
+				return nil, fmt.Errorf("invalid okta authenticator URL: %w", err)
+			}
+			cfg.OktaURL = oktaURL
+		}
+
+	case sf.AuthTypeOAuth:
+		token := purl.Query().Get("token")
+		if token == "" {
+			return nil, ErrNoToken
+		}
+		cfg.Token = token
+
+	case sf.AuthTypeExternalBrowser:
+		// no additional credentials required; the browser flow handles auth
+
+	default:
+		return nil, fmt.Errorf("unsupported authenticator %q", purl.Query().Get("authenticator"))
+	}
+
+	if passcode := purl.Query().Get("passcode"); passcode != "" {
+		cfg.Passcode = passcode
+	}
+	if purl.Query().Get("passcodeInPassword") == "true" {
+		cfg.PasscodeInPassword = true
 	}
 
 	dsn, err := sf.DSN(cfg)
@@ -150,30 +318,69 @@ func (p *Snowflake) Open(url string) (database.Driver, error) {
 		return nil, err
 	}
 
-	fmt.Printf("database is %s\n", database)
-	fmt.Printf("schema is %s\n", schema)
-	fmt.Printf("user is %s\n", cfg.User)
 	db, err := sql.Open("snowflake", dsn)
 	if err != nil {
-		fmt.Printf("open error\n\n")
 		return nil, err
 	}
 
 	migrationsTable := purl.Query().Get("x-migrations-table")
-	fmt.Printf("migrations table is %s\n", migrationsTable)
+
+	lockTimeout := defaultLockTimeout
+	if raw := purl.Query().Get("x-lock-timeout"); raw != "" {
+		lockTimeout, err = time.ParseDuration(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid x-lock-timeout: %w", err)
+		}
+	}
+
+	lockStaleAfter := defaultLockStaleAfter
+	if raw := purl.Query().Get("x-lock-stale-after"); raw != "" {
+		lockStaleAfter, err = time.ParseDuration(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid x-lock-stale-after: %w", err)
+		}
+	}
 
 	px, err := WithInstance(db, &Config{
-		DatabaseName:    database,
-		MigrationsTable: migrationsTable,
+		DatabaseName:              database,
+		SchemaName:                schema,
+		MigrationsTable:           migrationsTable,
+		LockTimeout:               lockTimeout,
+		LockStaleAfter:            lockStaleAfter,
+		MultiStatementTransaction: purl.Query().Get("x-multi-statement-transaction") == "true",
+		MigrationsTableSchema:     purl.Query().Get("x-migrations-table-schema"),
+		MigrationsTableTransient:  purl.Query().Get("x-migrations-table-transient") == "true",
+		MigrationsTableUnquoted:   purl.Query().Get("x-migrations-table-quoted") == "false",
 	})
 	if err != nil {
-		fmt.Printf("Other error\n")
 		return nil, err
 	}
 
 	return px, nil
 }
 
+// parseAuthenticator maps the `authenticator=` URL query parameter onto a
+// gosnowflake auth type. An empty value preserves the driver's original
+// behavior of authenticating via key pair (JWT). An okta authenticator is
+// identified by its URL (e.g. https://<okta-account>.okta.com) rather than
+// a fixed keyword.
+func parseAuthenticator(authenticator string) (sf.AuthType, error) {
+	switch {
+	case authenticator == "" || authenticator == "jwt":
+		return sf.AuthTypeJwt, nil
+	case authenticator == "snowflake":
+		return sf.AuthTypeSnowflake, nil
+	case authenticator == "oauth":
+		return sf.AuthTypeOAuth, nil
+	case authenticator == "externalbrowser":
+		return sf.AuthTypeExternalBrowser, nil
+	case strings.HasPrefix(authenticator, "https://"):
+		return sf.AuthTypeOkta, nil
+	default:
+		return 0, fmt.Errorf("unknown authenticator %q", authenticator)
+	}
+}
+
 func (p *Snowflake) Close() error {
 	connErr := p.conn.Close()
 	dbErr := p.db.Close()
@@ -183,10 +390,20 @@ func (p *Snowflake) Close() error {
 	return nil
 }
 
+// Lock acquires a distributed advisory lock backed by a row in the
+// lockTableIdent table, so that two migrate processes pointed at the same
+// database/schema/migrations table cannot run migrations concurrently.
+// isLocked additionally guards against a single process calling Lock twice.
 func (p *Snowflake) Lock() error {
 	if !p.isLocked.CAS(false, true) {
 		return database.ErrLocked
 	}
+
+	if err := p.acquireAdvisoryLock(); err != nil {
+		p.isLocked.Store(false)
+		return err
+	}
+
 	return nil
 }
 
@@ -194,76 +411,207 @@ func (p *Snowflake) Unlock() error {
 	if !p.isLocked.CAS(true, false) {
 		return database.ErrNotLocked
 	}
+
+	return p.releaseAdvisoryLock()
+}
+
+// lockTableIdent is the schema-qualified, quoted (per MigrationsTableSchema
+// / MigrationsTableUnquoted) identifier of the table holding advisory lock
+// rows, kept alongside (and named after) the migrations table it protects.
+func (p *Snowflake) lockTableIdent() string {
+	return p.qualifyIdentifier(p.config.MigrationsTable + "_lock")
+}
+
+// advisoryLockKey deterministically identifies the thing being locked
+// (this database/schema's migrations table), mirroring the golang-migrate
+// Postgres advisory-lock pattern where the lock key is derived from the
+// target rather than chosen by the caller.
+func (p *Snowflake) advisoryLockKey() string {
+	sum := sha256.Sum256([]byte(p.config.DatabaseName + "." + p.config.SchemaName + "." + p.config.MigrationsTable))
+	return hex.EncodeToString(sum[:])
+}
+
+// ensureLockTable creates the lock table if needed and seeds it with a
+// single released row for key, if that row doesn't already exist. The row
+// is seeded up front (rather than by tryAcquireAdvisoryLock's UPDATE)
+// because UPDATE only serializes acquisition attempts against an existing
+// row: it cannot also be the thing that first brings the row into
+// existence without reopening the race it's meant to close.
+func (p *Snowflake) ensureLockTable(key string) error {
+	query := `CREATE TABLE IF NOT EXISTS ` + p.lockTableIdent() + ` (
+			lock_key STRING NOT NULL PRIMARY KEY,
+			held BOOLEAN NOT NULL,
+			acquired_by STRING,
+			acquired_at TIMESTAMP_NTZ)`
+	if _, err := p.conn.ExecContext(context.Background(), query); err != nil {
+		return &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+
+	query = `MERGE INTO ` + p.lockTableIdent() + ` AS t
+			USING (SELECT $1 AS lock_key) AS s
+			ON t.lock_key = s.lock_key
+			WHEN NOT MATCHED THEN INSERT (lock_key, held, acquired_by, acquired_at)
+				VALUES (s.lock_key, FALSE, NULL, NULL)`
+	if _, err := p.conn.ExecContext(context.Background(), query, key); err != nil {
+		return &database.Error{OrigErr: err, Query: []byte(query)}
+	}
 	return nil
 }
 
-func (p *Snowflake) Run(migration io.Reader) error {
-	migr, err := io.ReadAll(migration)
+// acquirerID identifies the caller of Lock for diagnosing stale lock rows:
+// the Snowflake session ID, hostname, and PID.
+func (p *Snowflake) acquirerID() (string, error) {
+	var sessionID string
+	query := `SELECT CURRENT_SESSION()`
+	if err := p.conn.QueryRowContext(context.Background(), query).Scan(&sessionID); err != nil {
+		return "", &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("session=%s host=%s pid=%d", sessionID, hostname, os.Getpid()), nil
+}
+
+// tryAcquireAdvisoryLock attempts to flip key's pre-seeded lock row from
+// released to held, failing (without error) if it's already held by a
+// still-live acquirer. Unlike an INSERT ... WHERE NOT EXISTS, this UPDATE
+// takes Snowflake's row-level lock on the target partition, so concurrent
+// callers serialize against each other instead of both reading "no row
+// yet" under snapshot isolation and both proceeding.
+//
+// A row held past staleAfter is treated as abandoned (the acquirer crashed
+// or was killed without reaching Unlock) and is stolen rather than left to
+// wedge every future migration until an operator deletes it by hand; this
+// mirrors how a PG advisory lock auto-releases when its holding session
+// disconnects.
+func (p *Snowflake) tryAcquireAdvisoryLock(key, acquirer string, staleAfter time.Duration) (bool, error) {
+	query := `UPDATE ` + p.lockTableIdent() + ` SET held = TRUE, acquired_by = $2, acquired_at = CURRENT_TIMESTAMP()
+			WHERE lock_key = $1 AND (held = FALSE OR acquired_at < DATEADD('second', $3, CURRENT_TIMESTAMP()))`
+	res, err := p.conn.ExecContext(context.Background(), query, key, acquirer, -int64(staleAfter/time.Second))
+	if err != nil {
+		return false, &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+
+	return n == 1, nil
+}
+
+func (p *Snowflake) acquireAdvisoryLock() error {
+	key := p.advisoryLockKey()
+
+	if err := p.ensureLockTable(key); err != nil {
+		return err
+	}
+
+	acquirer, err := p.acquirerID()
 	if err != nil {
 		return err
 	}
 
-	// run migration
-	query := string(migr[:])
-	p.conn.ExecContext(context.Background(), fmt.Sprintf("ALTER SESSION SET multi_statement_count=0"))
-	if _, err := p.conn.ExecContext(context.Background(), query); err != nil {
-		if pgErr, ok := err.(*pq.Error); ok {
-			var line uint
-			var col uint
-			var lineColOK bool
-			if pgErr.Position != "" {
-				if pos, err := strconv.ParseUint(pgErr.Position, 10, 64); err == nil {
-					line, col, lineColOK = computeLineFromPos(query, int(pos))
-				}
-			}
-			message := fmt.Sprintf("migration failed: %s", pgErr.Message)
-			if lineColOK {
-				message = fmt.Sprintf("%s (column %d)", message, col)
-			}
-			if pgErr.Detail != "" {
-				message = fmt.Sprintf("%s, %s", message, pgErr.Detail)
-			}
-			return database.Error{OrigErr: err, Err: message, Query: migr, Line: line}
+	timeout := p.config.LockTimeout
+	if timeout <= 0 {
+		timeout = defaultLockTimeout
+	}
+	deadline := time.Now().Add(timeout)
+
+	staleAfter := p.config.LockStaleAfter
+	if staleAfter <= 0 {
+		staleAfter = defaultLockStaleAfter
+	}
+
+	backoff := 100 * time.Millisecond
+	const maxBackoff = 2 * time.Second
+	for {
+		acquired, err := p.tryAcquireAdvisoryLock(key, acquirer, staleAfter)
+		if err != nil {
+			return err
+		}
+		if acquired {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return database.ErrLocked
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
 		}
-		return database.Error{OrigErr: err, Err: "migration failed", Query: migr}
 	}
+}
 
+func (p *Snowflake) releaseAdvisoryLock() error {
+	query := `UPDATE ` + p.lockTableIdent() + ` SET held = FALSE, acquired_by = NULL, acquired_at = NULL
+			WHERE lock_key = $1 AND held = TRUE`
+	if _, err := p.conn.ExecContext(context.Background(), query, p.advisoryLockKey()); err != nil {
+		return &database.Error{OrigErr: err, Query: []byte(query)}
+	}
 	return nil
 }
 
-func computeLineFromPos(s string, pos int) (line uint, col uint, ok bool) {
-	// replace crlf with lf
-	s = strings.Replace(s, "\r\n", "\n", -1)
-	// pg docs: pos uses index 1 for the first character, and positions are measured in characters not bytes
-	runes := []rune(s)
-	if pos > len(runes) {
-		return 0, 0, false
-	}
-	sel := runes[:pos]
-	line = uint(runesCount(sel, newLine) + 1)
-	col = uint(pos - 1 - runesLastIndex(sel, newLine))
-	return line, col, true
+// sqlExecer is satisfied by both *sql.Conn and *sql.Tx, letting Run share
+// its statement loop between the transactional and non-transactional paths.
+type sqlExecer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
 }
 
-const newLine = '\n'
+func (p *Snowflake) Run(migration io.Reader) error {
+	start := time.Now()
+	defer func() { p.lastRunDuration = time.Since(start) }()
+
+	ctx := context.Background()
+
+	var execer sqlExecer = p.conn
+	var tx *sql.Tx
+	if p.config.MultiStatementTransaction {
+		var err error
+		tx, err = p.conn.BeginTx(ctx, &sql.TxOptions{})
+		if err != nil {
+			return &database.Error{OrigErr: err, Err: "transaction start failed"}
+		}
+		execer = tx
+	}
 
-func runesCount(input []rune, target rune) int {
-	var count int
-	for _, r := range input {
-		if r == target {
-			count++
+	err := splitSQLStatements(migration, func(stmt sqlStatement) error {
+		if _, err := execer.ExecContext(ctx, stmt.text); err != nil {
+			return statementError(err, stmt)
+		}
+		return nil
+	})
+	if err != nil {
+		if tx != nil {
+			if errRollback := tx.Rollback(); errRollback != nil {
+				err = multierror.Append(err, errRollback)
+			}
 		}
+		return err
 	}
-	return count
-}
 
-func runesLastIndex(input []rune, target rune) int {
-	for i := len(input) - 1; i >= 0; i-- {
-		if input[i] == target {
-			return i
+	if tx != nil {
+		if err := tx.Commit(); err != nil {
+			return &database.Error{OrigErr: err, Err: "transaction commit failed"}
 		}
 	}
-	return -1
+
+	return nil
+}
+
+// statementError wraps the failure of a single migration statement with
+// enough context to locate it in the original file: its ordinal position,
+// byte offset, and a preview of its text.
+func statementError(err error, stmt sqlStatement) error {
+	const maxPreviewLen = 200
+	preview := stmt.text
+	if len(preview) > maxPreviewLen {
+		preview = preview[:maxPreviewLen]
+	}
+
+	message := fmt.Sprintf("migration failed executing statement %d (byte offset %d): %s", stmt.ordinal, stmt.offset, preview)
+	return database.Error{OrigErr: err, Err: message, Query: []byte(stmt.text)}
 }
 
 func (p *Snowflake) SetVersion(version int, dirty bool) error {
@@ -272,7 +620,7 @@ func (p *Snowflake) SetVersion(version int, dirty bool) error {
 		return &database.Error{OrigErr: err, Err: "transaction start failed"}
 	}
 
-	query := `DELETE FROM "` + p.config.MigrationsTable + `"`
+	query := `DELETE FROM ` + p.migrationsTableIdent()
 	if _, err := tx.Exec(query); err != nil {
 		if errRollback := tx.Rollback(); errRollback != nil {
 			err = multierror.Append(err, errRollback)
@@ -284,7 +632,7 @@ func (p *Snowflake) SetVersion(version int, dirty bool) error {
 	// empty schema version for failed down migration on the first migration
 	// See: https://github.com/golang-migrate/migrate/issues/330
 	if version >= 0 || (version == database.NilVersion && dirty) {
-		query = `INSERT INTO "` + p.config.MigrationsTable + `" (version,
+		query = `INSERT INTO ` + p.migrationsTableIdent() + ` (version,
 				dirty) VALUES (` + strconv.FormatInt(int64(version), 10) + `,
 				` + strconv.FormatBool(dirty) + `)`
 		if _, err := tx.Exec(query); err != nil {
@@ -295,6 +643,19 @@ func (p *Snowflake) SetVersion(version int, dirty bool) error {
 		}
 	}
 
+	executionMS := p.lastRunDuration.Milliseconds()
+	p.lastRunDuration = 0
+
+	historyQuery := `INSERT INTO ` + p.historyTableIdent() + ` (version, dirty, applied_at, applied_by, execution_ms)
+			VALUES (` + strconv.FormatInt(int64(version), 10) + `, ` + strconv.FormatBool(dirty) + `,
+			CURRENT_TIMESTAMP(), CURRENT_USER(), ` + strconv.FormatInt(executionMS, 10) + `)`
+	if _, err := tx.Exec(historyQuery); err != nil {
+		if errRollback := tx.Rollback(); errRollback != nil {
+			err = multierror.Append(err, errRollback)
+		}
+		return &database.Error{OrigErr: err, Query: []byte(historyQuery)}
+	}
+
 	if err := tx.Commit(); err != nil {
 		return &database.Error{OrigErr: err, Err: "transaction commit failed"}
 	}
@@ -303,7 +664,7 @@ func (p *Snowflake) SetVersion(version int, dirty bool) error {
 }
 
 func (p *Snowflake) Version() (version int, dirty bool, err error) {
-	query := `SELECT version, dirty FROM "` + p.config.MigrationsTable + `" LIMIT 1`
+	query := `SELECT version, dirty FROM ` + p.migrationsTableIdent() + ` LIMIT 1`
 	err = p.conn.QueryRowContext(context.Background(), query).Scan(&version, &dirty)
 	switch {
 	case err == sql.ErrNoRows:
@@ -322,10 +683,50 @@ func (p *Snowflake) Version() (version int, dirty bool, err error) {
 	}
 }
 
+// HistoryEntry is one version transition recorded by SetVersion into the
+// migrations table's history log.
+type HistoryEntry struct {
+	Version     int
+	Dirty       bool
+	AppliedAt   time.Time
+	AppliedBy   string
+	ExecutionMS int64
+}
+
+// History returns every version transition SetVersion has recorded, most
+// recent first.
+func (p *Snowflake) History() ([]HistoryEntry, error) {
+	query := `SELECT version, dirty, applied_at, applied_by, execution_ms FROM ` + p.historyTableIdent() + ` ORDER BY applied_at DESC`
+	rows, err := p.conn.QueryContext(context.Background(), query)
+	if err != nil {
+		return nil, &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	defer rows.Close()
+
+	var history []HistoryEntry
+	for rows.Next() {
+		var h HistoryEntry
+		if err := rows.Scan(&h.Version, &h.Dirty, &h.AppliedAt, &h.AppliedBy, &h.ExecutionMS); err != nil {
+			return nil, err
+		}
+		history = append(history, h)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+
+	return history, nil
+}
+
 func (p *Snowflake) Drop() (err error) {
-	// select all tables in current schema
-	query := `SELECT table_name FROM information_schema.tables WHERE table_schema=(SELECT current_schema()) AND table_type='BASE TABLE'`
-	tables, err := p.conn.QueryContext(context.Background(), query)
+	// select all tables in the migrations table's schema, along with the
+	// schema name as Snowflake actually stored it (not as configured),
+	// so the later DROP TABLE is qualified with a name that's guaranteed
+	// to resolve rather than one re-derived from a possibly-differently-cased
+	// config value
+	schemaClause, schemaArgs := p.schemaCondition(1)
+	query := `SELECT table_schema, table_name FROM information_schema.tables WHERE ` + schemaClause + ` AND table_type='BASE TABLE'`
+	tables, err := p.conn.QueryContext(context.Background(), query, schemaArgs...)
 	if err != nil {
 		return &database.Error{OrigErr: err, Query: []byte(query)}
 	}
@@ -336,14 +737,18 @@ func (p *Snowflake) Drop() (err error) {
 	}()
 
 	// delete one table after another
-	tableNames := make([]string, 0)
+	type qualifiedTable struct {
+		schema string
+		name   string
+	}
+	var tableNames []qualifiedTable
 	for tables.Next() {
-		var tableName string
-		if err := tables.Scan(&tableName); err != nil {
+		var t qualifiedTable
+		if err := tables.Scan(&t.schema, &t.name); err != nil {
 			return err
 		}
-		if len(tableName) > 0 {
-			tableNames = append(tableNames, tableName)
+		if len(t.name) > 0 {
+			tableNames = append(tableNames, t)
 		}
 	}
 	if err := tables.Err(); err != nil {
@@ -353,7 +758,9 @@ func (p *Snowflake) Drop() (err error) {
 	if len(tableNames) > 0 {
 		// delete one by one ...
 		for _, t := range tableNames {
-			query = `DROP TABLE IF EXISTS ` + t + ` CASCADE`
+			// always quoted: these names are already in the case Snowflake
+			// stored them in, whatever MigrationsTableUnquoted says
+			query = `DROP TABLE IF EXISTS "` + t.schema + `"."` + t.name + `" CASCADE`
 			if _, err := p.conn.ExecContext(context.Background(), query); err != nil {
 				return &database.Error{OrigErr: err, Query: []byte(query)}
 			}
@@ -381,19 +788,36 @@ func (p *Snowflake) ensureVersionTable() (err error) {
 		}
 	}()
 
+	transient := ""
+	if p.config.MigrationsTableTransient {
+		transient = "TRANSIENT "
+	}
+
 	// check if migration table exists
 	var count int
-	query := `SELECT COUNT(1) FROM information_schema.tables WHERE table_name = $1 AND table_schema = (SELECT current_schema()) LIMIT 1`
-	if err := p.conn.QueryRowContext(context.Background(), query, p.config.MigrationsTable).Scan(&count); err != nil {
+	schemaClause, schemaArgs := p.schemaCondition(2)
+	query := `SELECT COUNT(1) FROM information_schema.tables WHERE table_name = $1 AND ` + schemaClause + ` LIMIT 1`
+	args := append([]interface{}{p.migrationsTableNameForComparison()}, schemaArgs...)
+	if err := p.conn.QueryRowContext(context.Background(), query, args...).Scan(&count); err != nil {
 		return &database.Error{OrigErr: err, Query: []byte(query)}
 	}
-	if count == 1 {
-		return nil
+	if count != 1 {
+		// if not, create the empty migration table
+		query = `CREATE ` + transient + `TABLE if not exists ` + p.migrationsTableIdent() + ` (
+				version bigint not null primary key, dirty boolean not null)`
+		if _, err := p.conn.ExecContext(context.Background(), query); err != nil {
+			return &database.Error{OrigErr: err, Query: []byte(query)}
+		}
 	}
 
-	// if not, create the empty migration table
-	query = `CREATE TABLE if not exists "` + p.config.MigrationsTable + `" (
-			version bigint not null primary key, dirty boolean not null)`
+	// the history log is append-only, so it has no version/dirty "current
+	// row" invariant to check for; CREATE ... IF NOT EXISTS is enough.
+	query = `CREATE ` + transient + `TABLE if not exists ` + p.historyTableIdent() + ` (
+			version bigint not null,
+			dirty boolean not null,
+			applied_at TIMESTAMP_NTZ not null,
+			applied_by STRING not null,
+			execution_ms NUMBER not null)`
 	if _, err := p.conn.ExecContext(context.Background(), query); err != nil {
 		return &database.Error{OrigErr: err, Query: []byte(query)}
 	}
@@ -401,10 +825,54 @@ func (p *Snowflake) ensureVersionTable() (err error) {
 	return nil
 }
 
-func GetPrivateKey(pKey string) (*rsa.PrivateKey, error) {
+// readPrivateKeyString resolves the raw (still PEM/base64-encoded) private
+// key material from the URL query string, preferring privateKeyPath over an
+// inline privateKey if both are set.
+func readPrivateKeyString(purl *nurl.URL) (string, error) {
+	if path := purl.Query().Get("privateKeyPath"); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read privateKeyPath %q: %w", path, err)
+		}
+		return string(b), nil
+	}
+
+	return strings.ReplaceAll(purl.Query().Get("privateKey"), `\n`, "\n"), nil
+}
+
+// GetPrivateKey parses pKey, a PKCS#8 private key, into an *rsa.PrivateKey.
+// pKey may be a PEM-encoded blob or that same PEM blob base64-encoded (the
+// latter is convenient when shipping keys through env vars or secret
+// stores). If the PEM block is an "ENCRYPTED PRIVATE KEY", passphrase is
+// used to decrypt it; passphrase is ignored for unencrypted keys.
+func GetPrivateKey(pKey string, passphrase string) (*rsa.PrivateKey, error) {
 	privateKeyBlock, _ := pem.Decode([]byte(pKey))
 	if privateKeyBlock == nil {
-		return nil, errors.New("could not decode private key from config")
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(pKey))
+		if err != nil {
+			return nil, errors.New("could not decode private key from config")
+		}
+		privateKeyBlock, _ = pem.Decode(decoded)
+		if privateKeyBlock == nil {
+			return nil, errors.New("could not decode private key from config")
+		}
+	}
+
+	if privateKeyBlock.Type == "ENCRYPTED PRIVATE KEY" {
+		if passphrase == "" {
+			return nil, errors.New("private key is encrypted but no privateKeyPassphrase was provided")
+		}
+
+		pk, err := pkcs8.ParsePKCS8PrivateKey(privateKeyBlock.Bytes, []byte(passphrase))
+		if err != nil {
+			return nil, err
+		}
+
+		privKey, ok := pk.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("unable to parse private key")
+		}
+		return privKey, nil
 	}
 
 	pk, err := x509.ParsePKCS8PrivateKey(privateKeyBlock.Bytes)
@@ -0,0 +1,362 @@
+package snowflake
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"unicode"
+)
+
+// sqlStatement is a single statement extracted from a migration by
+// splitSQLStatements, along with its 1-based ordinal and the byte offset
+// in the original stream at which it starts. Both are attached to errors
+// so a failure can be traced back to the statement that caused it.
+type sqlStatement struct {
+	ordinal int
+	offset  int
+	text    string
+}
+
+// splitSQLStatements streams r, splitting it on top-level semicolons and
+// invoking handle with each statement in order. It respects Snowflake's
+// quoting rules so that a semicolon inside any of the following does not
+// terminate a statement: single-quoted strings (with escaped quotes),
+// $$ / $tag$ dollar-quoted bodies (stored procedure and UDF definitions),
+// `--` line comments, /* */ block comments, and BEGIN...END / CASE...END
+// blocks (Snowflake Scripting). Only the statement currently being
+// accumulated is held in memory at any one time, rather than the whole
+// migration. A stray semicolon (e.g. "SELECT 1;;") or a fragment that
+// contains nothing but comments (e.g. a trailing "-- note" with no
+// statement after it) yields no content once semicolons and comments are
+// stripped, and is skipped rather than handed to handle; Snowflake itself
+// silently ignores such empty statements between semicolons, and sending
+// one through ExecContext instead fails with "empty SQL statement".
+// Iteration stops as soon as handle returns an error, which
+// splitSQLStatements then returns unwrapped.
+func splitSQLStatements(r io.Reader, handle func(sqlStatement) error) error {
+	br := bufio.NewReader(r)
+	p := &sqlParser{}
+
+	var (
+		offset    int
+		stmtStart int
+		ordinal   int
+	)
+
+	emit := func() error {
+		raw := p.buf.String()
+		text := strings.TrimSpace(raw)
+		// skip the whitespace that TrimSpace drops from the front of text
+		start := stmtStart + len(raw) - len(strings.TrimLeftFunc(raw, unicode.IsSpace))
+		p.buf.Reset()
+		stmtStart = offset
+		if text == "" || isInertStatement(text) {
+			return nil
+		}
+
+		ordinal++
+		return handle(sqlStatement{ordinal: ordinal, offset: start, text: text})
+	}
+
+	for {
+		b, err := br.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		consumed, terminated := p.feed(b, br)
+		offset += consumed
+
+		if terminated {
+			if err := emit(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return emit()
+}
+
+// sqlParserState tracks what kind of run of bytes is currently being
+// consumed so that a `;` encountered mid-run is not treated as a
+// statement terminator.
+type sqlParserState int
+
+const (
+	stateDefault sqlParserState = iota
+	stateSingleQuote
+	stateLineComment
+	stateBlockComment
+	stateDollarQuote
+)
+
+// endModifiers are the keywords that, immediately following "END", close
+// a construct (IF/FOR/LOOP/WHILE) that never pushed itself onto
+// blockStack in the first place, so the "END <keyword>" pair pops
+// nothing. Without this, e.g. the "END IF" inside a BEGIN...END block
+// would be mistaken for the block's own closing END.
+var endModifiers = map[string]bool{
+	"IF":    true,
+	"FOR":   true,
+	"LOOP":  true,
+	"WHILE": true,
+}
+
+// sqlParser is a small streaming state machine that recognizes the
+// Snowflake SQL constructs splitSQLStatements needs to step over: quoted
+// strings, comments, dollar-quoted bodies, and BEGIN...END / CASE...END
+// blocks.
+type sqlParser struct {
+	buf   strings.Builder
+	state sqlParserState
+
+	dollarDelim string // e.g. "$$" or "$tag$", set upon entering stateDollarQuote
+	dollarTail  []byte // rolling window of the last len(dollarDelim) bytes
+
+	word strings.Builder
+
+	// blockStack holds one entry per currently-open BEGIN or CASE block,
+	// both of which close with a bare "END" (unlike IF/FOR/LOOP/WHILE,
+	// which close with "END IF"/"END FOR"/etc. and so never push here).
+	// A top-level `;` is only a statement terminator when this is empty.
+	blockStack []string
+
+	// pendingEnd is true right after flushing a bare "END" word, until
+	// the next word (or the statement terminator, whichever comes
+	// first) reveals whether it was actually "END IF"/"END LOOP"/etc.
+	pendingEnd bool
+}
+
+// feed consumes the token starting at b, reading further bytes from br
+// when b begins a multi-byte token (`--`, `/*`, a dollar-quote tag, or an
+// escaped quote). It returns how many bytes were consumed in total and
+// whether b (or the end of a multi-byte token) was an unquoted, top-level
+// statement terminator.
+func (p *sqlParser) feed(b byte, br *bufio.Reader) (consumed int, terminated bool) {
+	p.buf.WriteByte(b)
+	consumed = 1
+
+	switch p.state {
+	case stateLineComment:
+		if b == '\n' {
+			p.state = stateDefault
+		}
+		return
+
+	case stateBlockComment:
+		if b == '*' {
+			if next, err := br.Peek(1); err == nil && next[0] == '/' {
+				nb, _ := br.ReadByte()
+				p.buf.WriteByte(nb)
+				consumed++
+				p.state = stateDefault
+			}
+		}
+		return
+
+	case stateSingleQuote:
+		if b == '\'' {
+			if next, err := br.Peek(1); err == nil && next[0] == '\'' {
+				nb, _ := br.ReadByte()
+				p.buf.WriteByte(nb)
+				consumed++
+				return
+			}
+			p.state = stateDefault
+		}
+		return
+
+	case stateDollarQuote:
+		p.dollarTail = append(p.dollarTail, b)
+		if len(p.dollarTail) > len(p.dollarDelim) {
+			p.dollarTail = p.dollarTail[len(p.dollarTail)-len(p.dollarDelim):]
+		}
+		if string(p.dollarTail) == p.dollarDelim {
+			p.state = stateDefault
+			p.dollarDelim = ""
+			p.dollarTail = nil
+		}
+		return
+	}
+
+	// stateDefault
+	switch b {
+	case '\'':
+		p.flushWord()
+		p.state = stateSingleQuote
+
+	case '-':
+		if next, err := br.Peek(1); err == nil && next[0] == '-' {
+			nb, _ := br.ReadByte()
+			p.buf.WriteByte(nb)
+			consumed++
+			p.flushWord()
+			p.state = stateLineComment
+		}
+
+	case '/':
+		if next, err := br.Peek(1); err == nil && next[0] == '*' {
+			nb, _ := br.ReadByte()
+			p.buf.WriteByte(nb)
+			consumed++
+			p.flushWord()
+			p.state = stateBlockComment
+		}
+
+	case '$':
+		p.flushWord()
+		tag := []byte{'$'}
+		for {
+			next, err := br.Peek(1)
+			if err != nil {
+				break
+			}
+			c := next[0]
+			if c == '$' {
+				nb, _ := br.ReadByte()
+				p.buf.WriteByte(nb)
+				consumed++
+				tag = append(tag, c)
+				break
+			}
+			if !isIdentByte(c) {
+				break
+			}
+			nb, _ := br.ReadByte()
+			p.buf.WriteByte(nb)
+			consumed++
+			tag = append(tag, c)
+		}
+		if len(tag) >= 2 && tag[len(tag)-1] == '$' {
+			p.dollarDelim = string(tag)
+			p.dollarTail = nil
+			p.state = stateDollarQuote
+		}
+
+	case ';':
+		p.flushWord()
+		p.resolvePendingEnd()
+		if len(p.blockStack) == 0 {
+			terminated = true
+		}
+
+	default:
+		if isIdentByte(b) {
+			p.word.WriteByte(b)
+		} else {
+			p.flushWord()
+		}
+	}
+
+	return
+}
+
+// flushWord hands the identifier just scanned off to onWord and resets
+// the scratch buffer.
+func (p *sqlParser) flushWord() {
+	if p.word.Len() == 0 {
+		return
+	}
+
+	w := strings.ToUpper(p.word.String())
+	p.word.Reset()
+	p.onWord(w)
+}
+
+// onWord updates blockStack for the Snowflake Scripting keyword w. A bare
+// "END" doesn't immediately pop the stack: it might turn out to be the
+// first half of "END IF"/"END FOR"/"END LOOP"/"END WHILE", which closes a
+// construct that never pushed onto blockStack and so pops nothing. That
+// is only known once the following word (or the statement terminator,
+// via resolvePendingEnd) is seen.
+func (p *sqlParser) onWord(w string) {
+	if p.pendingEnd {
+		p.pendingEnd = false
+		if endModifiers[w] {
+			return
+		}
+		p.popBlock()
+		// w itself still needs to be evaluated below, e.g. "END BEGIN"
+		// (nonsensical SQL, but handled consistently either way).
+	}
+
+	switch w {
+	case "BEGIN", "CASE":
+		p.blockStack = append(p.blockStack, w)
+	case "END":
+		p.pendingEnd = true
+	}
+}
+
+// resolvePendingEnd finalizes a bare "END" that was immediately followed
+// by the statement terminator rather than another word, e.g. "...END;".
+func (p *sqlParser) resolvePendingEnd() {
+	if !p.pendingEnd {
+		return
+	}
+	p.pendingEnd = false
+	p.popBlock()
+}
+
+func (p *sqlParser) popBlock() {
+	if len(p.blockStack) > 0 {
+		p.blockStack = p.blockStack[:len(p.blockStack)-1]
+	}
+}
+
+func isIdentByte(b byte) bool {
+	return b == '_' || (b >= '0' && b <= '9') || (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z')
+}
+
+// isInertStatement reports whether text, a candidate statement already
+// trimmed of leading/trailing whitespace, has no content once trailing
+// semicolons, surrounding whitespace, and comments are stripped away - a
+// lone ";" or a comment-only fragment such as "-- note", neither of which
+// is a statement Snowflake expects to execute.
+func isInertStatement(text string) bool {
+	stripped := stripSQLComments(text)
+	stripped = strings.Trim(stripped, "; \t\r\n")
+	return stripped == ""
+}
+
+// stripSQLComments removes `--` line comments and /* */ block comments
+// from s, leaving single-quoted string contents untouched so a "--" or
+// "/*" inside a literal isn't mistaken for the start of a comment.
+func stripSQLComments(s string) string {
+	var b strings.Builder
+	inSingleQuote := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if inSingleQuote {
+			b.WriteByte(c)
+			if c == '\'' {
+				inSingleQuote = false
+			}
+			continue
+		}
+		switch {
+		case c == '\'':
+			inSingleQuote = true
+			b.WriteByte(c)
+		case c == '-' && i+1 < len(s) && s[i+1] == '-':
+			nl := strings.IndexByte(s[i:], '\n')
+			if nl == -1 {
+				return b.String()
+			}
+			b.WriteByte('\n')
+			i += nl
+		case c == '/' && i+1 < len(s) && s[i+1] == '*':
+			end := strings.Index(s[i+2:], "*/")
+			if end == -1 {
+				return b.String()
+			}
+			i += 2 + end + 1
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
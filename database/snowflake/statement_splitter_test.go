@@ -0,0 +1,145 @@
+package snowflake
+
+import (
+	"strings"
+	"testing"
+)
+
+func splitAll(t *testing.T, sql string) []string {
+	t.Helper()
+
+	var got []string
+	err := splitSQLStatements(strings.NewReader(sql), func(stmt sqlStatement) error {
+		got = append(got, stmt.text)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("splitSQLStatements(%q) returned error: %v", sql, err)
+	}
+	return got
+}
+
+func TestSplitSQLStatements(t *testing.T) {
+	tests := []struct {
+		name string
+		sql  string
+		want []string
+	}{
+		{
+			name: "basic semicolon splitting",
+			sql:  "SELECT 1; SELECT 2;",
+			want: []string{"SELECT 1;", "SELECT 2;"},
+		},
+		{
+			name: "no trailing semicolon",
+			sql:  "SELECT 1; SELECT 2",
+			want: []string{"SELECT 1;", "SELECT 2"},
+		},
+		{
+			name: "semicolon inside single-quoted string",
+			sql:  `INSERT INTO t (v) VALUES ('a;b');`,
+			want: []string{`INSERT INTO t (v) VALUES ('a;b');`},
+		},
+		{
+			name: "escaped quote inside single-quoted string",
+			sql:  `SELECT 'it''s; fine';`,
+			want: []string{`SELECT 'it''s; fine';`},
+		},
+		{
+			name: "semicolon inside line comment",
+			sql:  "SELECT 1; -- trailing; comment\nSELECT 2;",
+			want: []string{"SELECT 1;", "-- trailing; comment\nSELECT 2;"},
+		},
+		{
+			name: "semicolon inside block comment",
+			sql:  "SELECT 1; /* a; block; comment */ SELECT 2;",
+			want: []string{"SELECT 1;", "/* a; block; comment */ SELECT 2;"},
+		},
+		{
+			name: "semicolon inside dollar-quoted body",
+			sql:  "CREATE PROCEDURE p() AS $$ BEGIN SELECT 1; END $$;",
+			want: []string{"CREATE PROCEDURE p() AS $$ BEGIN SELECT 1; END $$;"},
+		},
+		{
+			name: "semicolon inside tagged dollar-quoted body",
+			sql:  "CREATE PROCEDURE p() AS $tag$ SELECT 1; $tag$;",
+			want: []string{"CREATE PROCEDURE p() AS $tag$ SELECT 1; $tag$;"},
+		},
+		{
+			name: "BEGIN...END block with internal semicolons",
+			sql:  "CREATE PROCEDURE p() AS BEGIN SELECT 1; SELECT 2; END;",
+			want: []string{"CREATE PROCEDURE p() AS BEGIN SELECT 1; SELECT 2; END;"},
+		},
+		{
+			name: "END IF does not close the enclosing BEGIN block",
+			sql:  "CREATE PROCEDURE p() AS BEGIN IF (1=1) THEN SELECT 1; END IF; SELECT 2; END;",
+			want: []string{"CREATE PROCEDURE p() AS BEGIN IF (1=1) THEN SELECT 1; END IF; SELECT 2; END;"},
+		},
+		{
+			name: "END LOOP/END FOR/END WHILE do not close the enclosing BEGIN block",
+			sql:  "CREATE PROCEDURE p() AS BEGIN FOR i IN 1..3 DO SELECT i; END FOR; WHILE (1=1) DO SELECT 1; END WHILE; LOOP SELECT 1; END LOOP; END;",
+			want: []string{"CREATE PROCEDURE p() AS BEGIN FOR i IN 1..3 DO SELECT i; END FOR; WHILE (1=1) DO SELECT 1; END WHILE; LOOP SELECT 1; END LOOP; END;"},
+		},
+		{
+			name: "CASE...END does not close the enclosing BEGIN block",
+			sql:  "CREATE PROCEDURE p() AS BEGIN SELECT CASE WHEN 1=1 THEN 1 ELSE 2 END; SELECT 2; END;",
+			want: []string{"CREATE PROCEDURE p() AS BEGIN SELECT CASE WHEN 1=1 THEN 1 ELSE 2 END; SELECT 2; END;"},
+		},
+		{
+			name: "blank lines between statements are trimmed, not merged away",
+			sql:  "SELECT 1;\n\n;\n\nSELECT 2;",
+			want: []string{"SELECT 1;", "SELECT 2;"},
+		},
+		{
+			name: "stray semicolon between statements is skipped",
+			sql:  "SELECT 1;; SELECT 2;",
+			want: []string{"SELECT 1;", "SELECT 2;"},
+		},
+		{
+			name: "trailing comment-only fragment is skipped",
+			sql:  "SELECT 1;\n-- note",
+			want: []string{"SELECT 1;"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitAll(t, tt.sql)
+			if len(got) != len(tt.want) {
+				t.Fatalf("splitSQLStatements(%q) = %d statements %q, want %d statements %q", tt.sql, len(got), got, len(tt.want), tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("statement %d = %q, want %q", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSplitSQLStatementsStopsOnHandlerError(t *testing.T) {
+	sentinel := strings.NewReader("SELECT 1; SELECT 2; SELECT 3;")
+
+	var seen []string
+	wantErr := &statementHandlerError{}
+	err := splitSQLStatements(sentinel, func(stmt sqlStatement) error {
+		seen = append(seen, stmt.text)
+		if len(seen) == 2 {
+			return wantErr
+		}
+		return nil
+	})
+
+	if err != wantErr {
+		t.Fatalf("splitSQLStatements returned error %v, want %v", err, wantErr)
+	}
+	if len(seen) != 2 {
+		t.Fatalf("handler was called %d times, want 2 (splitting should stop once it returns an error)", len(seen))
+	}
+}
+
+// statementHandlerError is a distinct error type used only to confirm that
+// splitSQLStatements returns a handler's error unwrapped.
+type statementHandlerError struct{}
+
+func (*statementHandlerError) Error() string { return "handler stopped" }